@@ -0,0 +1,169 @@
+package gazette
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies a compression format fragments may be stored under.
+type Codec string
+
+const (
+	// CodecNone stores fragments uncompressed, as today.
+	CodecNone Codec = "none"
+	// CodecGzip compresses fragments with gzip.
+	CodecGzip Codec = "gzip"
+	// CodecZstd compresses fragments with zstd. This is the default: it
+	// gives gzip-or-better ratios at a fraction of the CPU cost.
+	CodecZstd Codec = "zstd"
+	// CodecSnappy compresses fragments with snappy, favoring speed over
+	// ratio.
+	CodecSnappy Codec = "snappy"
+)
+
+// defaultCodec is used for journals without an explicit codec override.
+const defaultCodec = CodecZstd
+
+// defaultZstdLevel is a low compression level chosen to keep convergence
+// CPU-cheap; it still beats gzip's default ratio on typical text journals.
+const defaultZstdLevel = zstd.SpeedDefault
+
+// codecSuffix returns the filename extension appended to a fragment's
+// content name when stored under |codec|, e.g. ".zst". The remote object
+// name (and therefore its etcd lock key) must incorporate this suffix so
+// that re-converging under a different codec can't collide with a
+// previous upload.
+func codecSuffix(codec Codec) string {
+	switch codec {
+	case CodecNone:
+		return ""
+	case CodecGzip:
+		return ".gz"
+	case CodecZstd:
+		return ".zst"
+	case CodecSnappy:
+		return ".snappy"
+	default:
+		return ""
+	}
+}
+
+// codecFromContentName recovers the Codec a stored object was compressed
+// with, by inspecting its trailing extension.
+func codecFromContentName(name string) Codec {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return CodecGzip
+	case strings.HasSuffix(name, ".zst"):
+		return CodecZstd
+	case strings.HasSuffix(name, ".snappy"):
+		return CodecSnappy
+	default:
+		return CodecNone
+	}
+}
+
+// compressingReader wraps |r| such that reading from it yields |codec|-
+// compressed output of |r|'s content.
+func compressingReader(codec Codec, r io.Reader) (io.Reader, error) {
+	pr, pw := io.Pipe()
+
+	var w io.WriteCloser
+	switch codec {
+	case CodecNone:
+		return r, nil
+	case CodecGzip:
+		w = gzip.NewWriter(pw)
+	case CodecZstd:
+		zw, err := zstd.NewWriter(pw, zstd.WithEncoderLevel(defaultZstdLevel))
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	case CodecSnappy:
+		w = snappy.NewBufferedWriter(pw)
+	default:
+		return nil, errors.New("compress: unknown codec " + string(codec))
+	}
+
+	go func() {
+		_, err := io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// compressBuffer returns the |codec|-compressed encoding of |buf| as an
+// independent, self-contained stream. Chunked uploads call this once per
+// chunk rather than compressing across chunk boundaries: gzip, zstd and
+// snappy readers all transparently decode a concatenation of such streams
+// as one continuous logical stream, so the chunk boundary is invisible to
+// decompressingReader on the read path.
+func compressBuffer(codec Codec, buf []byte) ([]byte, error) {
+	r, err := compressingReader(codec, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// decompressingReader wraps |src| such that reading from it yields the
+// decompressed content of a |codec|-compressed stream. Closing the result
+// also closes |src|.
+func decompressingReader(codec Codec, src io.ReadCloser) (io.ReadCloser, error) {
+	var decoded io.Reader
+	var closeDecoder func() error
+
+	switch codec {
+	case CodecNone:
+		decoded = src
+	case CodecGzip:
+		gzr, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		decoded, closeDecoder = gzr, gzr.Close
+	case CodecZstd:
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		decoded = zr
+		closeDecoder = func() error { zr.Close(); return nil }
+	case CodecSnappy:
+		decoded = snappy.NewReader(src)
+	default:
+		return nil, errors.New("compress: unknown codec " + string(codec))
+	}
+
+	return &decompressedReadCloser{Reader: decoded, closeDecoder: closeDecoder, src: src}, nil
+}
+
+// decompressedReadCloser composes a decoder's Reader with closing both the
+// decoder (if it owns resources) and the underlying compressed source.
+type decompressedReadCloser struct {
+	io.Reader
+	closeDecoder func() error
+	src          io.Closer
+}
+
+func (d *decompressedReadCloser) Close() error {
+	var err error
+	if d.closeDecoder != nil {
+		err = d.closeDecoder()
+	}
+	if cerr := d.src.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+package gazette
+
+// lockManager acquires and releases the convergence lock a Persister holds
+// for the duration it's uploading a fragment, so that only one broker ever
+// attempts to persist a given fragment at a time. Implementations own
+// whatever session/lease keepalive is needed to keep a held lock alive;
+// Persister.convergeOne itself does no refreshing.
+//
+// It also persists the small amount of state a resumable upload needs to
+// survive a crash: the resume token of an in-progress chunked upload,
+// keyed the same way as the lock it's associated with.
+type lockManager interface {
+	// TryLock attempts to acquire the lock named by |key|. It returns
+	// (true, nil) if the lock was acquired, or (false, nil) if another
+	// holder already has it.
+	TryLock(key string) (bool, error)
+	// Unlock releases a lock previously acquired with TryLock(key). It is
+	// only ever called for a key this lockManager currently holds.
+	Unlock(key string) error
+
+	// SaveResumeToken persists |token| as the resume point for a
+	// partially-completed chunked upload of |key|.
+	SaveResumeToken(key, token string) error
+	// LoadResumeToken returns the token previously saved for |key| by
+	// SaveResumeToken, or "" if none exists.
+	LoadResumeToken(key string) (string, error)
+	// ClearResumeToken removes the resume token for |key|, once its upload
+	// has completed.
+	ClearResumeToken(key string) error
+}
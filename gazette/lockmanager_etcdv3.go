@@ -0,0 +1,104 @@
+package gazette
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+)
+
+// etcdV3LockManager implements lockManager atop etcd v3 concurrency
+// primitives. Each held lock gets its own clientv3.Session (and therefore
+// its own lease), so the v3 client's built-in keepalive refreshes it for as
+// long as the process is alive; on a crash the lease simply expires and the
+// lock disappears, with no orphaned entry to clean up.
+type etcdV3LockManager struct {
+	client *clientv3.Client
+	root   string
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	holds map[string]*lockHold
+}
+
+type lockHold struct {
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+// newEtcdV3LockManager returns a lockManager whose locks live under |root|
+// (e.g. PersisterLocksRoot) and whose backing leases carry |ttl|.
+func newEtcdV3LockManager(client *clientv3.Client, root string, ttl time.Duration) *etcdV3LockManager {
+	return &etcdV3LockManager{
+		client: client,
+		root:   root,
+		ttl:    ttl,
+		holds:  make(map[string]*lockHold),
+	}
+}
+
+func (m *etcdV3LockManager) TryLock(key string) (bool, error) {
+	session, err := concurrency.NewSession(m.client, concurrency.WithTTL(int(m.ttl/time.Second)))
+	if err != nil {
+		return false, err
+	}
+	mutex := concurrency.NewMutex(session, m.root+key)
+
+	if err := mutex.TryLock(context.Background()); err == concurrency.ErrLocked {
+		session.Close()
+		return false, nil
+	} else if err != nil {
+		session.Close()
+		return false, err
+	}
+
+	m.mu.Lock()
+	m.holds[key] = &lockHold{session: session, mutex: mutex}
+	m.mu.Unlock()
+	return true, nil
+}
+
+func (m *etcdV3LockManager) Unlock(key string) error {
+	m.mu.Lock()
+	hold := m.holds[key]
+	delete(m.holds, key)
+	m.mu.Unlock()
+
+	if hold == nil {
+		return nil
+	}
+	err := hold.mutex.Unlock(context.Background())
+	if cerr := hold.session.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// resumeTokenKey returns the etcd key a chunked upload's resume token is
+// stored under: a sibling of the fragment's lock key, rather than a child
+// of it, so it outlives any individual lock hold.
+func (m *etcdV3LockManager) resumeTokenKey(key string) string {
+	return m.root + key + ".resume"
+}
+
+func (m *etcdV3LockManager) SaveResumeToken(key, token string) error {
+	_, err := m.client.Put(context.Background(), m.resumeTokenKey(key), token)
+	return err
+}
+
+func (m *etcdV3LockManager) LoadResumeToken(key string) (string, error) {
+	resp, err := m.client.Get(context.Background(), m.resumeTokenKey(key))
+	if err != nil {
+		return "", err
+	} else if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+func (m *etcdV3LockManager) ClearResumeToken(key string) error {
+	_, err := m.client.Delete(context.Background(), m.resumeTokenKey(key))
+	return err
+}
@@ -0,0 +1,118 @@
+package gazette
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/pippio/api-server/cloudstore"
+)
+
+// ErrObjectNotFound is returned by ObjectStore.Stat and ObjectStore.Open
+// when the requested path has no corresponding object.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectAttrs describes metadata attached to an object at upload time.
+// Backends are free to ignore attributes they don't support.
+type ObjectAttrs struct {
+	ContentType     string
+	ContentEncoding string
+}
+
+// ObjectInfo is returned by ObjectStore.Stat and ObjectStore.List.
+type ObjectInfo struct {
+	Path         string
+	Size         int64
+	LastModified time.Time
+}
+
+// ObjectStore is the minimal surface Persister needs from a remote object
+// store. It's implemented by each supported cloud provider, plus a local
+// implementation backed by cloudstore.FileSystem for tests and single-node
+// deployments.
+type ObjectStore interface {
+	// Upload writes the full contents of |r| to |path|, creating or
+	// replacing the object. |attrs| may be nil.
+	Upload(path string, r io.Reader, attrs *ObjectAttrs) error
+	// Stat returns metadata for |path|, or ErrObjectNotFound if it doesn't
+	// exist.
+	Stat(path string) (ObjectInfo, error)
+	// Open returns a reader over the contents of |path|. Callers must
+	// Close() the returned reader.
+	Open(path string) (io.ReadCloser, error)
+	// Delete removes |path|. It is not an error if |path| does not exist.
+	Delete(path string) error
+	// List enumerates objects having |prefix|.
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// ObjectStoreConfig is the YAML-serializable configuration for an
+// ObjectStore, modeled on the "type" + per-type bucket config shape used by
+// Thanos's objstore package. Exactly one of the provider-specific sections
+// should be populated, matching |Type|.
+type ObjectStoreConfig struct {
+	// Type selects the backend: "LOCAL", "S3", "GCS", or "AZURE".
+	Type string `yaml:"type"`
+
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"`
+
+	S3    S3Config    `yaml:"s3,omitempty"`
+	GCS   GCSConfig   `yaml:"gcs,omitempty"`
+	Azure AzureConfig `yaml:"azure,omitempty"`
+}
+
+// S3Config holds credentials and endpoint overrides for the S3 backend.
+type S3Config struct {
+	Region          string `yaml:"region"`
+	Endpoint        string `yaml:"endpoint,omitempty"`
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+}
+
+// GCSConfig holds credentials for the Google Cloud Storage backend.
+type GCSConfig struct {
+	ServiceAccountJSON string `yaml:"service_account_json,omitempty"`
+}
+
+// AzureConfig holds credentials for the Azure Blob Storage backend.
+type AzureConfig struct {
+	StorageAccount   string `yaml:"storage_account"`
+	StorageAccessKey string `yaml:"storage_access_key,omitempty"`
+}
+
+// NewObjectStore parses |blob| as an ObjectStoreConfig and constructs the
+// backend it names.
+func NewObjectStore(blob []byte) (ObjectStore, error) {
+	var cfg ObjectStoreConfig
+	if err := yaml.Unmarshal(blob, &cfg); err != nil {
+		return nil, err
+	}
+	return NewObjectStoreFromConfig(cfg)
+}
+
+// NewObjectStoreFromConfig constructs the ObjectStore named by |cfg.Type|.
+func NewObjectStoreFromConfig(cfg ObjectStoreConfig) (ObjectStore, error) {
+	switch cfg.Type {
+	case "LOCAL":
+		// |cfg.Bucket| is the root directory fragments are persisted under;
+		// unlike cloudstore.NewTmpFileSystem() (used only by tests), this
+		// must survive process restarts for single-node deployments to keep
+		// access to previously-converged fragments.
+		cfs, err := cloudstore.NewOSFileSystem(cfg.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		return newLocalObjectStore(cfs, cfg.Prefix), nil
+	case "S3":
+		return newS3ObjectStore(cfg.Bucket, cfg.Prefix, cfg.S3)
+	case "GCS":
+		return newGCSObjectStore(cfg.Bucket, cfg.Prefix, cfg.GCS)
+	case "AZURE":
+		return newAzureObjectStore(cfg.Bucket, cfg.Prefix, cfg.Azure)
+	default:
+		return nil, errors.New("objectstore: unknown type " + cfg.Type)
+	}
+}
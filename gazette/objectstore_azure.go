@@ -0,0 +1,216 @@
+package gazette
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// azureObjectStore implements ObjectStore against an Azure Blob Storage
+// container.
+type azureObjectStore struct {
+	prefix    string
+	container azblob.ContainerURL
+}
+
+func newAzureObjectStore(container, prefix string, cfg AzureConfig) (*azureObjectStore, error) {
+	credential, err := azblob.NewSharedKeyCredential(cfg.StorageAccount, cfg.StorageAccessKey)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+
+	u, err := url.Parse("https://" + cfg.StorageAccount + ".blob.core.windows.net/" + container)
+	if err != nil {
+		return nil, err
+	}
+	return &azureObjectStore{prefix: prefix, container: azblob.NewContainerURL(*u, pipeline)}, nil
+}
+
+func (s *azureObjectStore) fullPath(p string) string {
+	return path.Join(s.prefix, p)
+}
+
+// relPath is fullPath's inverse: it recovers the caller-relative path from a
+// fully-qualified blob name returned by the Azure API (e.g. from List), so
+// results can be fed straight back into Stat/Open/Delete like every other
+// backend.
+func (s *azureObjectStore) relPath(full string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(full, s.prefix), "/")
+}
+
+func (s *azureObjectStore) blob(p string) azblob.BlockBlobURL {
+	return s.container.NewBlockBlobURL(s.fullPath(p))
+}
+
+func (s *azureObjectStore) Upload(p string, r io.Reader, attrs *ObjectAttrs) error {
+	var headers azblob.BlobHTTPHeaders
+	if attrs != nil {
+		headers.ContentType = attrs.ContentType
+		headers.ContentEncoding = attrs.ContentEncoding
+	}
+	_, err := azblob.UploadStreamToBlockBlob(context.Background(), r, s.blob(p),
+		azblob.UploadStreamToBlockBlobOptions{BufferSize: 4 * 1024 * 1024, MaxBuffers: 4, BlobHTTPHeaders: headers})
+	return err
+}
+
+func (s *azureObjectStore) Stat(p string) (ObjectInfo, error) {
+	props, err := s.blob(p).GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if isAzureNotFound(err) {
+		return ObjectInfo{}, ErrObjectNotFound
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Path: p, Size: props.ContentLength(), LastModified: props.LastModified()}, nil
+}
+
+func (s *azureObjectStore) Open(p string) (io.ReadCloser, error) {
+	resp, err := s.blob(p).Download(context.Background(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if isAzureNotFound(err) {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+func (s *azureObjectStore) Delete(p string) error {
+	_, err := s.blob(p).Delete(context.Background(), azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if isAzureNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *azureObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	var out []ObjectInfo
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := s.container.ListBlobsFlatSegment(context.Background(), marker,
+			azblob.ListBlobsSegmentOptions{Prefix: s.fullPath(prefix)})
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range resp.Segment.BlobItems {
+			out = append(out, ObjectInfo{Path: s.relPath(b.Name), Size: *b.Properties.ContentLength, LastModified: b.Properties.LastModified})
+		}
+		marker = resp.NextMarker
+	}
+	return out, nil
+}
+
+// OpenChunkedUpload implements ChunkedObjectStore atop Azure's staged-block
+// protocol: each WriteChunk stages one more block via StageBlock, and Close
+// finalizes the blob with a single Put Block List. |resumeToken|, when
+// non-empty, is the JSON-encoded azureResumeState of a previously started
+// upload, identified by the ordered block IDs we'd staged.
+func (s *azureObjectStore) OpenChunkedUpload(p string, resumeToken string) (ChunkedUpload, error) {
+	blob := s.blob(p)
+
+	var state azureResumeState
+	if resumeToken != "" {
+		if err := json.Unmarshal([]byte(resumeToken), &state); err != nil {
+			return nil, err
+		}
+	}
+
+	acked, confirmed, err := confirmStagedBlocks(blob, state.BlockIDs)
+	if err != nil {
+		return nil, err
+	}
+	state.BlockIDs = confirmed
+
+	return &azureChunkedUpload{blob: blob, state: state, acked: acked}, nil
+}
+
+// confirmStagedBlocks asks Azure which prefix of |blockIDs| (in the order
+// WriteChunk staged them) it actually has durably staged, per GetBlockList,
+// rather than trusting a possibly-stale local resume token: we may have
+// crashed between a StageBlock call succeeding and persisting that fact.
+// Any block missing from the service's uncommitted list, and everything
+// staged after it, is dropped, since WriteChunk always appends the next
+// sequential chunk and a gap would otherwise upload out of order.
+func confirmStagedBlocks(blob azblob.BlockBlobURL, blockIDs []string) (acked int64, confirmed []string, err error) {
+	if len(blockIDs) == 0 {
+		return 0, nil, nil
+	}
+	list, err := blob.GetBlockList(context.Background(), azblob.BlockListUncommitted, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return 0, nil, err
+	}
+	sizes := make(map[string]int64, len(list.UncommittedBlocks))
+	for _, b := range list.UncommittedBlocks {
+		sizes[b.Name] = int64(b.Size)
+	}
+	for _, id := range blockIDs {
+		size, ok := sizes[id]
+		if !ok {
+			break
+		}
+		acked += size
+		confirmed = append(confirmed, id)
+	}
+	return acked, confirmed, nil
+}
+
+// azureResumeState is the JSON-serialized ChunkedUpload.Token() for an
+// in-progress Azure staged-block upload.
+type azureResumeState struct {
+	BlockIDs []string `json:"block_ids"`
+}
+
+type azureChunkedUpload struct {
+	blob  azblob.BlockBlobURL
+	state azureResumeState
+	acked int64
+}
+
+func (u *azureChunkedUpload) BytesAcked() int64 { return u.acked }
+
+func (u *azureChunkedUpload) Token() string {
+	b, _ := json.Marshal(u.state)
+	return string(b)
+}
+
+func (u *azureChunkedUpload) WriteChunk(chunk []byte) error {
+	id := azureBlockID(len(u.state.BlockIDs))
+
+	if _, err := u.blob.StageBlock(context.Background(), id, bytes.NewReader(chunk),
+		azblob.LeaseAccessConditions{}, nil); err != nil {
+		return err
+	}
+	u.state.BlockIDs = append(u.state.BlockIDs, id)
+	u.acked += int64(len(chunk))
+	return nil
+}
+
+func (u *azureChunkedUpload) Close() error {
+	_, err := u.blob.CommitBlockList(context.Background(), u.state.BlockIDs,
+		azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+	return err
+}
+
+// azureBlockID derives the block ID staged for the chunk at |index|. Block
+// IDs within a blob must all base64-decode to the same length, so the index
+// is zero-padded before encoding, and they must sort in upload order, since
+// Put Block List commits them in the order given by Token()'s BlockIDs.
+func azureBlockID(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", index)))
+}
+
+func isAzureNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if serr, ok := err.(azblob.StorageError); ok {
+		return serr.ServiceCode() == azblob.ServiceCodeBlobNotFound
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+//go:build azure_integration
+// +build azure_integration
+
+package gazette
+
+import (
+	"os"
+
+	gc "github.com/go-check/check"
+)
+
+// AzureObjectStoreSuite runs objectStoreConformance against a real Azure
+// Blob Storage container. It's gated behind the azure_integration build tag
+// and GAZETTE_TEST_AZURE_CONTAINER / GAZETTE_TEST_AZURE_ACCOUNT /
+// GAZETTE_TEST_AZURE_KEY, since it requires a live storage account.
+type AzureObjectStoreSuite struct {
+	objectStoreConformance
+}
+
+func (s *AzureObjectStoreSuite) SetUpTest(c *gc.C) {
+	container := os.Getenv("GAZETTE_TEST_AZURE_CONTAINER")
+	if container == "" {
+		c.Skip("GAZETTE_TEST_AZURE_CONTAINER not set")
+	}
+	store, err := newAzureObjectStore(container, "gazette-test/"+c.TestName(), AzureConfig{
+		StorageAccount:   os.Getenv("GAZETTE_TEST_AZURE_ACCOUNT"),
+		StorageAccessKey: os.Getenv("GAZETTE_TEST_AZURE_KEY"),
+	})
+	c.Assert(err, gc.IsNil)
+	s.store = store
+}
+
+var _ = gc.Suite(&AzureObjectStoreSuite{})
@@ -0,0 +1,321 @@
+package gazette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/cloud/storage"
+)
+
+// gcsResumableScope is the OAuth2 scope needed both by the high-level
+// storage.Client and by the raw resumable-upload HTTP calls OpenChunkedUpload
+// makes directly against the JSON API (which google.golang.org/cloud/storage
+// doesn't expose chunk-by-chunk control over).
+const gcsResumableScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsObjectStore implements ObjectStore against a Google Cloud Storage
+// bucket.
+type gcsObjectStore struct {
+	bucket string
+	prefix string
+	client *storage.Client
+	http   *http.Client
+	ctx    context.Context
+}
+
+func newGCSObjectStore(bucket, prefix string, cfg GCSConfig) (*gcsObjectStore, error) {
+	ctx := context.Background()
+
+	var opts []option.ClientOption
+	if cfg.ServiceAccountJSON != "" {
+		opts = append(opts, option.WithCredentialsJSON([]byte(cfg.ServiceAccountJSON)))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := gcsHTTPClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsObjectStore{bucket: bucket, prefix: prefix, client: client, http: httpClient, ctx: ctx}, nil
+}
+
+// gcsHTTPClient returns an authenticated client suitable for the raw
+// resumable-upload requests OpenChunkedUpload issues directly against the
+// JSON API.
+func gcsHTTPClient(ctx context.Context, cfg GCSConfig) (*http.Client, error) {
+	if cfg.ServiceAccountJSON == "" {
+		return google.DefaultClient(ctx, gcsResumableScope)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, []byte(cfg.ServiceAccountJSON), gcsResumableScope)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
+func (s *gcsObjectStore) fullPath(p string) string {
+	return path.Join(s.prefix, p)
+}
+
+// relPath is fullPath's inverse: it recovers the caller-relative path from a
+// fully-qualified object name returned by the GCS API (e.g. from List), so
+// results can be fed straight back into Stat/Open/Delete like every other
+// backend.
+func (s *gcsObjectStore) relPath(full string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(full, s.prefix), "/")
+}
+
+func (s *gcsObjectStore) object(p string) *storage.ObjectHandle {
+	return s.client.Bucket(s.bucket).Object(s.fullPath(p))
+}
+
+func (s *gcsObjectStore) Upload(p string, r io.Reader, attrs *ObjectAttrs) error {
+	w := s.object(p).NewWriter(s.ctx)
+	if attrs != nil {
+		w.ContentType = attrs.ContentType
+		w.ContentEncoding = attrs.ContentEncoding
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *gcsObjectStore) Stat(p string) (ObjectInfo, error) {
+	attrs, err := s.object(p).Attrs(s.ctx)
+	if err == storage.ErrObjectNotExist {
+		return ObjectInfo{}, ErrObjectNotFound
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Path: p, Size: attrs.Size, LastModified: attrs.Updated}, nil
+}
+
+func (s *gcsObjectStore) Open(p string) (io.ReadCloser, error) {
+	r, err := s.object(p).NewReader(s.ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrObjectNotFound
+	}
+	return r, err
+}
+
+func (s *gcsObjectStore) Delete(p string) error {
+	err := s.object(p).Delete(s.ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+func (s *gcsObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	it := s.client.Bucket(s.bucket).Objects(s.ctx, &storage.Query{Prefix: s.fullPath(prefix)})
+	var out []ObjectInfo
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, ObjectInfo{Path: s.relPath(attrs.Name), Size: attrs.Size, LastModified: attrs.Updated})
+	}
+	return out, nil
+}
+
+// OpenChunkedUpload implements ChunkedObjectStore atop GCS's resumable
+// upload protocol: |resumeToken|, when non-empty, is the JSON-encoded
+// gcsResumeState of a previously started session, identified by the session
+// URI GCS handed back when it was initiated.
+func (s *gcsObjectStore) OpenChunkedUpload(p string, resumeToken string) (ChunkedUpload, error) {
+	var state gcsResumeState
+	if resumeToken != "" {
+		if err := json.Unmarshal([]byte(resumeToken), &state); err != nil {
+			return nil, err
+		}
+		acked, done, err := s.queryResumableOffset(state.SessionURI)
+		if err != nil {
+			return nil, err
+		}
+		state.Acked, state.Done = acked, done
+	} else {
+		uri, err := s.startResumableSession(s.fullPath(p))
+		if err != nil {
+			return nil, err
+		}
+		state.SessionURI = uri
+	}
+	return &gcsChunkedUpload{client: s.http, state: state}, nil
+}
+
+// startResumableSession initiates a new resumable upload session for |key|
+// and returns the session URI subsequent chunk PUTs are sent to.
+func (s *gcsObjectStore) startResumableSession(key string) (string, error) {
+	u := url.URL{
+		Scheme: "https",
+		Host:   "storage.googleapis.com",
+		Path:   "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o",
+	}
+	q := u.Query()
+	q.Set("uploadType", "resumable")
+	q.Set("name", key)
+	u.RawQuery = q.Encode()
+
+	resp, err := s.http.Post(u.String(), "application/json; charset=UTF-8", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcs: starting resumable upload: status %d", resp.StatusCode)
+	}
+	if uri := resp.Header.Get("Location"); uri != "" {
+		return uri, nil
+	}
+	return "", fmt.Errorf("gcs: resumable upload response missing Location header")
+}
+
+// queryResumableOffset asks GCS how many bytes of an in-progress resumable
+// upload it has durably received, per the "bytes */*" status-check form of
+// the resumable upload protocol. This is authoritative even if our own
+// locally-saved resume token is stale (e.g. we crashed between a chunk PUT
+// succeeding and persisting its resume token). A 200/201 response means a
+// prior attempt already finished and finalized the object: |done| is then
+// true and |acked| is the object's full size, not 0, so the caller resumes
+// at the end of the fragment (nothing left to upload) rather than at byte
+// zero against a session GCS has already closed out.
+func (s *gcsObjectStore) queryResumableOffset(sessionURI string) (acked int64, done bool, err error) {
+	req, err := http.NewRequest("PUT", sessionURI, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", "bytes */*")
+	req.ContentLength = 0
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var object struct {
+			Size string `json:"size"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+			return 0, false, err
+		}
+		size, err := strconv.ParseInt(object.Size, 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return size, true, nil
+	case 308: // Resume Incomplete
+		rng := resp.Header.Get("Range") // e.g. "bytes=0-8388607"
+		if rng == "" {
+			return 0, false, nil
+		}
+		var lo, hi int64
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &lo, &hi); err != nil {
+			return 0, false, err
+		}
+		return hi + 1, false, nil
+	default:
+		return 0, false, fmt.Errorf("gcs: querying resumable upload offset: status %d", resp.StatusCode)
+	}
+}
+
+// gcsResumeState is the JSON-serialized ChunkedUpload.Token() for a GCS
+// resumable upload session. Done is set once a status check has found the
+// session already finalized by a prior attempt, so Close knows not to
+// re-finalize it.
+type gcsResumeState struct {
+	SessionURI string `json:"session_uri"`
+	Acked      int64  `json:"acked"`
+	Done       bool   `json:"done"`
+}
+
+type gcsChunkedUpload struct {
+	client *http.Client
+	state  gcsResumeState
+}
+
+func (u *gcsChunkedUpload) BytesAcked() int64 { return u.state.Acked }
+
+func (u *gcsChunkedUpload) Token() string {
+	b, _ := json.Marshal(u.state)
+	return string(b)
+}
+
+func (u *gcsChunkedUpload) WriteChunk(chunk []byte) error {
+	start := u.state.Acked
+	end := start + int64(len(chunk)) - 1
+
+	req, err := http.NewRequest("PUT", u.state.SessionURI, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/*")
+	req.ContentLength = int64(len(chunk))
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 308 && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("gcs: uploading chunk: status %d", resp.StatusCode)
+	}
+	u.state.Acked = end + 1
+	return nil
+}
+
+// Close finalizes the upload. Every byte was already durably accepted by
+// the last successful WriteChunk; this sends a final, bodyless request that
+// now declares the total size, which GCS's resumable protocol accepts as
+// the finalization signal once it already has every byte up to that total.
+// If OpenChunkedUpload's status check already found the session finalized
+// by a prior attempt (u.state.Done), Close is a no-op: re-sending the
+// finalize request against an already-completed session has nothing to do
+// and GCS may reject it.
+func (u *gcsChunkedUpload) Close() error {
+	if u.state.Done {
+		return nil
+	}
+
+	req, err := http.NewRequest("PUT", u.state.SessionURI, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(u.state.Acked, 10))
+	req.ContentLength = 0
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("gcs: finalizing resumable upload: status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build gcs_integration
+// +build gcs_integration
+
+package gazette
+
+import (
+	"os"
+
+	gc "github.com/go-check/check"
+)
+
+// GCSObjectStoreSuite runs objectStoreConformance against a real GCS
+// bucket. It's gated behind the gcs_integration build tag and
+// GAZETTE_TEST_GCS_BUCKET, since it requires live GCS credentials (picked
+// up via application-default credentials, or GOOGLE_APPLICATION_CREDENTIALS
+// pointing at a service account JSON file).
+type GCSObjectStoreSuite struct {
+	objectStoreConformance
+}
+
+func (s *GCSObjectStoreSuite) SetUpTest(c *gc.C) {
+	bucket := os.Getenv("GAZETTE_TEST_GCS_BUCKET")
+	if bucket == "" {
+		c.Skip("GAZETTE_TEST_GCS_BUCKET not set")
+	}
+	store, err := newGCSObjectStore(bucket, "gazette-test/"+c.TestName(), GCSConfig{})
+	c.Assert(err, gc.IsNil)
+	s.store = store
+}
+
+var _ = gc.Suite(&GCSObjectStoreSuite{})
@@ -0,0 +1,126 @@
+package gazette
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pippio/api-server/cloudstore"
+)
+
+// localObjectStore adapts a cloudstore.FileSystem to the ObjectStore
+// interface. It backs the "LOCAL" ObjectStoreConfig type, and is what
+// Persister tests run against in place of a real cloud provider.
+type localObjectStore struct {
+	cfs    cloudstore.FileSystem
+	prefix string
+}
+
+func newLocalObjectStore(cfs cloudstore.FileSystem, prefix string) *localObjectStore {
+	return &localObjectStore{cfs: cfs, prefix: prefix}
+}
+
+func (s *localObjectStore) fullPath(path string) string {
+	return filepath.Join(s.prefix, path)
+}
+
+func (s *localObjectStore) Upload(path string, r io.Reader, _ *ObjectAttrs) error {
+	full := s.fullPath(path)
+	if err := s.cfs.MkdirAll(filepath.Dir(full), 0740); err != nil {
+		return err
+	}
+	w, err := s.cfs.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *localObjectStore) Stat(path string) (ObjectInfo, error) {
+	fi, err := s.cfs.Stat(s.fullPath(path))
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrObjectNotFound
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Path: path, Size: fi.Size(), LastModified: fi.ModTime()}, nil
+}
+
+func (s *localObjectStore) Open(path string) (io.ReadCloser, error) {
+	r, err := s.cfs.Open(s.fullPath(path))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return r, err
+}
+
+func (s *localObjectStore) Delete(path string) error {
+	err := s.cfs.Remove(s.fullPath(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	names, err := s.cfs.ListFiles(s.fullPath(prefix))
+	if err != nil {
+		return nil, err
+	}
+	var out []ObjectInfo
+	for _, fi := range names {
+		out = append(out, ObjectInfo{Path: filepath.Join(prefix, fi.Name()), Size: fi.Size(), LastModified: fi.ModTime()})
+	}
+	return out, nil
+}
+
+// OpenChunkedUpload implements ChunkedObjectStore. The local backend's
+// "resume" is simply reopening the file for append at its current size: a
+// cloudstore.FileSystem file is durable as soon as it's written, so there's
+// no separate session to track.
+func (s *localObjectStore) OpenChunkedUpload(path string, resumeToken string) (ChunkedUpload, error) {
+	full := s.fullPath(path)
+	if err := s.cfs.MkdirAll(filepath.Dir(full), 0740); err != nil {
+		return nil, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	var acked int64
+	if resumeToken != "" {
+		if fi, err := s.cfs.Stat(full); err == nil {
+			acked = fi.Size()
+		}
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	w, err := s.cfs.OpenFile(full, flags, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &localChunkedUpload{w: w, token: path, acked: acked}, nil
+}
+
+type localChunkedUpload struct {
+	w     io.WriteCloser
+	token string
+	acked int64
+}
+
+func (u *localChunkedUpload) BytesAcked() int64 { return u.acked }
+func (u *localChunkedUpload) Token() string     { return u.token }
+
+func (u *localChunkedUpload) WriteChunk(chunk []byte) error {
+	if _, err := u.w.Write(chunk); err != nil {
+		return err
+	}
+	u.acked += int64(len(chunk))
+	return nil
+}
+
+func (u *localChunkedUpload) Close() error { return u.w.Close() }
@@ -0,0 +1,217 @@
+package gazette
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3ObjectStore implements ObjectStore against an S3-compatible bucket.
+type s3ObjectStore struct {
+	bucket   string
+	prefix   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func newS3ObjectStore(bucket, prefix string, cfg S3Config) (*s3ObjectStore, error) {
+	awsConfig := aws.NewConfig().WithRegion(cfg.Region)
+	if cfg.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(cfg.Endpoint)
+	}
+	if cfg.AccessKeyID != "" {
+		awsConfig = awsConfig.WithCredentials(
+			credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, ""))
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &s3ObjectStore{
+		bucket:   bucket,
+		prefix:   prefix,
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *s3ObjectStore) fullPath(p string) string {
+	return path.Join(s.prefix, p)
+}
+
+// relPath is fullPath's inverse: it recovers the caller-relative path from a
+// fully-qualified key returned by the S3 API (e.g. from List), so results
+// can be fed straight back into Stat/Open/Delete like every other backend.
+func (s *s3ObjectStore) relPath(full string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(full, s.prefix), "/")
+}
+
+func (s *s3ObjectStore) Upload(p string, r io.Reader, attrs *ObjectAttrs) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fullPath(p)),
+		Body:   r,
+	}
+	if attrs != nil {
+		if attrs.ContentType != "" {
+			input.ContentType = aws.String(attrs.ContentType)
+		}
+		if attrs.ContentEncoding != "" {
+			input.ContentEncoding = aws.String(attrs.ContentEncoding)
+		}
+	}
+	_, err := s.uploader.Upload(input)
+	return err
+}
+
+func (s *s3ObjectStore) Stat(p string) (ObjectInfo, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fullPath(p)),
+	})
+	if isS3NotFound(err) {
+		return ObjectInfo{}, ErrObjectNotFound
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Path: p, Size: aws.Int64Value(out.ContentLength), LastModified: aws.TimeValue(out.LastModified)}, nil
+}
+
+func (s *s3ObjectStore) Open(p string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fullPath(p)),
+	})
+	if isS3NotFound(err) {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3ObjectStore) Delete(p string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fullPath(p)),
+	})
+	return err
+}
+
+func (s *s3ObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	var out []ObjectInfo
+	err := s.client.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.fullPath(prefix)),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			out = append(out, ObjectInfo{
+				Path:         s.relPath(aws.StringValue(obj.Key)),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return out, err
+}
+
+// OpenChunkedUpload implements ChunkedObjectStore atop S3's native
+// multipart upload API: |resumeToken|, when non-empty, is the JSON-encoded
+// s3ResumeState of a previously started upload, letting us resume from the
+// last acknowledged part instead of calling CreateMultipartUpload again.
+func (s *s3ObjectStore) OpenChunkedUpload(p string, resumeToken string) (ChunkedUpload, error) {
+	key := s.fullPath(p)
+
+	var state s3ResumeState
+	if resumeToken != "" {
+		if err := json.Unmarshal([]byte(resumeToken), &state); err != nil {
+			return nil, err
+		}
+	}
+	if state.UploadID == "" {
+		out, err := s.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		state.UploadID = aws.StringValue(out.UploadId)
+	}
+	return &s3ChunkedUpload{client: s.client, bucket: s.bucket, key: key, state: state}, nil
+}
+
+// s3ResumeState is the JSON-serialized ChunkedUpload.Token() for an S3
+// multipart upload.
+type s3ResumeState struct {
+	UploadID string   `json:"upload_id"`
+	ETags    []string `json:"etags"`
+	Acked    int64    `json:"acked"`
+}
+
+type s3ChunkedUpload struct {
+	client *s3.S3
+	bucket string
+	key    string
+	state  s3ResumeState
+}
+
+func (u *s3ChunkedUpload) BytesAcked() int64 { return u.state.Acked }
+
+func (u *s3ChunkedUpload) Token() string {
+	b, _ := json.Marshal(u.state)
+	return string(b)
+}
+
+func (u *s3ChunkedUpload) WriteChunk(chunk []byte) error {
+	partNumber := int64(len(u.state.ETags) + 1)
+	out, err := u.client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(u.bucket),
+		Key:        aws.String(u.key),
+		UploadId:   aws.String(u.state.UploadID),
+		PartNumber: aws.Int64(partNumber),
+		Body:       bytes.NewReader(chunk),
+	})
+	if err != nil {
+		return err
+	}
+	u.state.ETags = append(u.state.ETags, aws.StringValue(out.ETag))
+	u.state.Acked += int64(len(chunk))
+	return nil
+}
+
+func (u *s3ChunkedUpload) Close() error {
+	parts := make([]*s3.CompletedPart, len(u.state.ETags))
+	for i, etag := range u.state.ETags {
+		parts[i] = &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(int64(i + 1))}
+	}
+	_, err := u.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.bucket),
+		Key:             aws.String(u.key),
+		UploadId:        aws.String(u.state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func isS3NotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	type awsError interface {
+		Code() string
+	}
+	if aerr, ok := err.(awsError); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
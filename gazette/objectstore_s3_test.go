@@ -0,0 +1,32 @@
+//go:build s3_integration
+// +build s3_integration
+
+package gazette
+
+import (
+	"os"
+
+	gc "github.com/go-check/check"
+)
+
+// S3ObjectStoreSuite runs objectStoreConformance against a real S3 bucket.
+// It's gated behind the s3_integration build tag and GAZETTE_TEST_S3_BUCKET,
+// since it requires live AWS credentials (picked up the usual way, e.g.
+// AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY / AWS_REGION env vars).
+type S3ObjectStoreSuite struct {
+	objectStoreConformance
+}
+
+func (s *S3ObjectStoreSuite) SetUpTest(c *gc.C) {
+	bucket := os.Getenv("GAZETTE_TEST_S3_BUCKET")
+	if bucket == "" {
+		c.Skip("GAZETTE_TEST_S3_BUCKET not set")
+	}
+	store, err := newS3ObjectStore(bucket, "gazette-test/"+c.TestName(), S3Config{
+		Region: os.Getenv("AWS_REGION"),
+	})
+	c.Assert(err, gc.IsNil)
+	s.store = store
+}
+
+var _ = gc.Suite(&S3ObjectStoreSuite{})
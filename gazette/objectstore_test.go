@@ -0,0 +1,76 @@
+package gazette
+
+import (
+	"io/ioutil"
+	"strings"
+
+	gc "github.com/go-check/check"
+
+	"github.com/pippio/api-server/cloudstore"
+)
+
+// objectStoreConformance is a conformance suite that any ObjectStore
+// implementation must satisfy. Embedders provide |store| via their own
+// SetUpTest; the local backend runs it unconditionally below, and the
+// S3/GCS/Azure backends each run the same suite under their own
+// credential-gated, build-tagged test files (objectstore_s3_test.go,
+// objectstore_gcs_test.go, objectstore_azure_test.go).
+type objectStoreConformance struct {
+	store ObjectStore
+}
+
+func (s *objectStoreConformance) TestUploadStatOpenRoundTrip(c *gc.C) {
+	_, err := s.store.Stat("some/path")
+	c.Check(err, gc.Equals, ErrObjectNotFound)
+
+	c.Assert(s.store.Upload("some/path", strings.NewReader("hello"), nil), gc.IsNil)
+
+	info, err := s.store.Stat("some/path")
+	c.Assert(err, gc.IsNil)
+	c.Check(info.Size, gc.Equals, int64(5))
+
+	r, err := s.store.Open("some/path")
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Check(string(content), gc.Equals, "hello")
+}
+
+func (s *objectStoreConformance) TestDeleteIsIdempotent(c *gc.C) {
+	c.Assert(s.store.Upload("some/path", strings.NewReader("hello"), nil), gc.IsNil)
+	c.Check(s.store.Delete("some/path"), gc.IsNil)
+	c.Check(s.store.Delete("some/path"), gc.IsNil)
+
+	_, err := s.store.Stat("some/path")
+	c.Check(err, gc.Equals, ErrObjectNotFound)
+}
+
+func (s *objectStoreConformance) TestList(c *gc.C) {
+	c.Assert(s.store.Upload("dir/a", strings.NewReader("a"), nil), gc.IsNil)
+	c.Assert(s.store.Upload("dir/b", strings.NewReader("bb"), nil), gc.IsNil)
+
+	infos, err := s.store.List("dir")
+	c.Assert(err, gc.IsNil)
+	c.Check(infos, gc.HasLen, 2)
+
+	// List results must be directly usable by Stat/Open/Delete, the same as
+	// any other backend-relative path.
+	for _, info := range infos {
+		_, err := s.store.Stat(info.Path)
+		c.Check(err, gc.IsNil)
+	}
+}
+
+// ObjectStoreSuite runs objectStoreConformance against the local backend,
+// the only one that can be driven without live cloud credentials.
+type ObjectStoreSuite struct {
+	objectStoreConformance
+}
+
+func (s *ObjectStoreSuite) SetUpTest(c *gc.C) {
+	s.store = newLocalObjectStore(cloudstore.NewTmpFileSystem(), "prefix")
+}
+
+var _ = gc.Suite(&ObjectStoreSuite{})
@@ -0,0 +1,408 @@
+package gazette
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+
+	"github.com/pippio/gazette/journal"
+)
+
+const (
+	// PersisterLocksRoot is the etcd directory under which a lock is held
+	// for the duration a fragment is being converged to |store|.
+	PersisterLocksRoot = "/persister/locks/"
+
+	// defaultPersisterLockTTL is the TTL given to the etcd v3 lease backing
+	// a persister lock. The v3 client keeps the lease (and therefore the
+	// lock) alive with its own keepalive for as long as the process holding
+	// it is running; convergeOne does no refreshing of its own.
+	defaultPersisterLockTTL = time.Minute
+
+	// queueDepthPerWorker bounds how many fragments may be buffered in
+	// Persister.queueCh ahead of a free worker, so that Persist() applies
+	// backpressure onto its caller once workers fall behind.
+	queueDepthPerWorker = 4
+)
+
+// Persister converges local journal fragments still resident on disk to a
+// remote ObjectStore, taking a lock for the duration of the upload so that
+// only one broker ever attempts to persist a given fragment.
+type Persister struct {
+	localDirectory string
+	store          ObjectStore
+	locks          lockManager
+	routeKey       string
+
+	// concurrency is the number of convergeOne workers run by Start, and
+	// maxInFlightBytes bounds the total uncompressed size of fragments those
+	// workers may be uploading at once. maxInFlightBytes <= 0 means
+	// unbounded.
+	concurrency      int
+	maxInFlightBytes int64
+
+	mu                sync.Mutex
+	queued            map[journal.Name][]journal.Fragment
+	journalCodecs     map[journal.Name]Codec
+	inFlightFragments map[string]bool
+	inFlightBytes     int64
+	inFlightFreed     *sync.Cond
+
+	queueCh   chan journal.Fragment
+	workersWG sync.WaitGroup
+
+	osRemove func(string) error
+}
+
+// NewPersister returns a Persister which converges fragments rooted at
+// |localDirectory| into |store|, coordinating through |etcdClient| so that
+// concurrent brokers sharing |store| don't double-upload a fragment.
+// |routeKey| identifies this broker in log messages. Up to |concurrency|
+// fragments are converged in parallel, subject to |maxInFlightBytes| of
+// total uncompressed size (<= 0 for unbounded). Call Start to begin
+// converging queued fragments, and Stop to drain and halt workers.
+func NewPersister(localDirectory string, store ObjectStore,
+	etcdClient *clientv3.Client, routeKey string,
+	concurrency int, maxInFlightBytes int64) *Persister {
+
+	locks := newEtcdV3LockManager(etcdClient, PersisterLocksRoot, defaultPersisterLockTTL)
+	return newPersister(localDirectory, store, locks, routeKey, concurrency, maxInFlightBytes)
+}
+
+// newPersister is the lockManager-parameterized constructor used by
+// NewPersister and by tests, which inject a fake lockManager in place of
+// etcdV3LockManager.
+func newPersister(localDirectory string, store ObjectStore, locks lockManager,
+	routeKey string, concurrency int, maxInFlightBytes int64) *Persister {
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	p := &Persister{
+		localDirectory:    localDirectory,
+		store:             store,
+		locks:             locks,
+		routeKey:          routeKey,
+		concurrency:       concurrency,
+		maxInFlightBytes:  maxInFlightBytes,
+		queued:            make(map[journal.Name][]journal.Fragment),
+		journalCodecs:     make(map[journal.Name]Codec),
+		inFlightFragments: make(map[string]bool),
+		queueCh:           make(chan journal.Fragment, concurrency*queueDepthPerWorker),
+		osRemove:          os.Remove,
+	}
+	p.inFlightFreed = sync.NewCond(&p.mu)
+	return p
+}
+
+// Start launches the Persister's worker pool. It must be called once,
+// before the first call to Persist.
+func (p *Persister) Start() {
+	for i := 0; i < p.concurrency; i++ {
+		p.workersWG.Add(1)
+		go p.worker()
+	}
+}
+
+// Stop closes the queue to new fragments and blocks until all workers have
+// finished draining it.
+func (p *Persister) Stop() {
+	close(p.queueCh)
+	p.workersWG.Wait()
+}
+
+func (p *Persister) worker() {
+	defer p.workersWG.Done()
+
+	for fragment := range p.queueCh {
+		p.convergeOneBounded(fragment)
+	}
+}
+
+// convergeOneBounded guards convergeOne with the per-fragment in-flight
+// tracking that lets String() and the worker pool coexist safely: two
+// workers must never attempt the same fragment concurrently, and the
+// in-flight byte budget consumed by Persist must be released once the
+// fragment is done (converged or abandoned).
+func (p *Persister) convergeOneBounded(fragment journal.Fragment) {
+	key := fragment.Journal.String() + "/" + fragment.ContentName()
+	release := func() {
+		p.mu.Lock()
+		p.inFlightBytes -= fragment.End - fragment.Begin
+		p.inFlightFreed.Broadcast()
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	if p.inFlightFragments[key] {
+		p.mu.Unlock()
+		// Another worker is already converging this fragment; this duplicate
+		// Persist() call's share of the in-flight byte budget was reserved
+		// for nothing, so it must still be released here.
+		release()
+		return
+	}
+	p.inFlightFragments[key] = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.inFlightFragments, key)
+		p.mu.Unlock()
+		release()
+	}()
+
+	p.convergeOne(fragment)
+}
+
+// SetJournalCodec configures the compression codec used when converging
+// fragments of |name| to the remote ObjectStore. Journals without an
+// explicit codec use defaultCodec.
+func (p *Persister) SetJournalCodec(name journal.Name, codec Codec) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.journalCodecs[name] = codec
+}
+
+func (p *Persister) codecFor(name journal.Name) Codec {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if codec, ok := p.journalCodecs[name]; ok {
+		return codec
+	}
+	return defaultCodec
+}
+
+// remotePath returns the path |fragment| is stored under in the remote
+// ObjectStore when compressed with |codec|. This incorporates the codec's
+// suffix so that fragments converged under different codecs (e.g. after a
+// journal's codec configuration changes) never collide.
+func (p *Persister) remotePath(fragment journal.Fragment, codec Codec) string {
+	return filepath.Join(fragment.Journal.String(), fragment.ContentName()+codecSuffix(codec))
+}
+
+// Persist enqueues |fragment| for convergence to the remote ObjectStore by
+// one of the Persister's workers. It blocks while |fragment| would push the
+// Persister's in-flight byte budget over maxInFlightBytes, and again while
+// the bounded queue to the worker pool is full: callers should expect
+// Persist to apply backpressure rather than buffer unboundedly.
+func (p *Persister) Persist(fragment journal.Fragment) {
+	size := fragment.End - fragment.Begin
+
+	p.mu.Lock()
+	p.queued[fragment.Journal] = append(p.queued[fragment.Journal], fragment)
+	// Wait for room in the budget, but never block forever: a fragment
+	// larger than maxInFlightBytes must still be let through once nothing
+	// else is in flight, or it would wait on a budget it can never fit.
+	for p.maxInFlightBytes > 0 && p.inFlightBytes > 0 && p.inFlightBytes+size > p.maxInFlightBytes {
+		p.inFlightFreed.Wait()
+	}
+	p.inFlightBytes += size
+	p.mu.Unlock()
+
+	p.queueCh <- fragment
+}
+
+// String returns a JSON summary of fragments currently queued for
+// convergence, keyed by journal name. It's safe to call concurrently.
+func (p *Persister) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make(map[string][]string, len(p.queued))
+	for name, fragments := range p.queued {
+		var l []string
+		for _, fragment := range fragments {
+			l = append(l, fragment.ContentName())
+		}
+		names[name.String()] = l
+	}
+	b, err := json.Marshal(names)
+	if err != nil {
+		log.Println("persister: marshaling String():", err)
+	}
+	return string(b)
+}
+
+func (p *Persister) dequeue(fragment journal.Fragment) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	remaining := p.queued[fragment.Journal][:0]
+	for _, other := range p.queued[fragment.Journal] {
+		if other != fragment {
+			remaining = append(remaining, other)
+		}
+	}
+	p.queued[fragment.Journal] = remaining
+}
+
+// convergeOne uploads a single |fragment| to the remote ObjectStore, if it's
+// not already present there, and removes the local copy on success. The
+// fragment's lock is held for the duration.
+func (p *Persister) convergeOne(fragment journal.Fragment) {
+	codec := p.codecFor(fragment.Journal)
+	remotePath := p.remotePath(fragment, codec)
+	lockKey := filepath.Base(remotePath)
+
+	held, err := p.locks.TryLock(lockKey)
+	if err != nil {
+		log.Println("persister[", p.routeKey, "]: obtaining lock:", err)
+		return
+	} else if !held {
+		return // Another broker already holds the lock.
+	}
+	defer func() {
+		if err := p.locks.Unlock(lockKey); err != nil {
+			log.Println("persister[", p.routeKey, "]: releasing lock:", err)
+		}
+	}()
+
+	// A non-empty resume token means a prior chunked upload of this fragment
+	// was interrupted partway through. A chunked backend may write in place to
+	// remotePath with no staging/rename (the local one does), so Stat succeeding in that case
+	// means only "a partial object exists", not "fully converged" — it must
+	// not short-circuit the upload, or the truncated object would be mistaken
+	// for the real thing and the local copy deleted out from under it.
+	resumeToken, err := p.locks.LoadResumeToken(lockKey)
+	if err != nil {
+		log.Println("persister[", p.routeKey, "]: loading resume token:", err)
+		return
+	}
+
+	converged := false
+	if resumeToken == "" {
+		if _, err := p.store.Stat(remotePath); err == nil {
+			converged = true
+		} else if err != ErrObjectNotFound {
+			log.Println("persister[", p.routeKey, "]: statting remote fragment:", err)
+			return
+		}
+	}
+	if !converged {
+		if err := p.upload(fragment, remotePath, lockKey, codec); err != nil {
+			log.Println("persister[", p.routeKey, "]: uploading fragment:", err)
+			return
+		}
+	}
+
+	localPath := filepath.Join(p.localDirectory, fragment.Journal.String(), fragment.ContentName())
+	if err := p.osRemove(localPath); err != nil {
+		log.Println("persister[", p.routeKey, "]: removing local fragment:", err)
+		return
+	}
+	p.dequeue(fragment)
+}
+
+// upload converges |fragment| to the remote ObjectStore, preferring a
+// resumable chunked upload when |p.store| supports one so that a crash
+// partway through a large fragment doesn't force re-uploading bytes the
+// store has already durably accepted.
+func (p *Persister) upload(fragment journal.Fragment, remotePath, lockKey string, codec Codec) error {
+	if chunked, ok := p.store.(ChunkedObjectStore); ok {
+		return p.uploadChunked(chunked, fragment, remotePath, lockKey, codec)
+	}
+	return p.uploadWhole(fragment, remotePath, codec)
+}
+
+func (p *Persister) uploadWhole(fragment journal.Fragment, remotePath string, codec Codec) error {
+	size := fragment.End - fragment.Begin
+	buffer := make([]byte, size)
+
+	if _, err := fragment.File.ReadAt(buffer, 0); err != nil && err != io.EOF {
+		return err
+	}
+	r, err := compressingReader(codec, bytes.NewReader(buffer))
+	if err != nil {
+		return err
+	}
+	return p.store.Upload(remotePath, r, nil)
+}
+
+// uploadChunked streams |fragment| to |store| part-by-part, persisting the
+// in-progress ChunkedUpload's resume token under |lockKey| after every
+// chunk so a subsequent attempt (by this process after a crash, or another
+// broker after taking over the lock) can resume from the last acknowledged
+// byte rather than re-reading and re-uploading the whole fragment. Each
+// chunk is compressed independently; see compressBuffer. Chunk size starts
+// at initialUploadChunkSize and doubles on every successful chunk, per
+// nextUploadChunkSize, to amortize per-chunk overhead on large fragments.
+func (p *Persister) uploadChunked(store ChunkedObjectStore, fragment journal.Fragment,
+	remotePath, lockKey string, codec Codec) error {
+
+	resumeToken, err := p.locks.LoadResumeToken(lockKey)
+	if err != nil {
+		return err
+	}
+	upload, err := store.OpenChunkedUpload(remotePath, resumeToken)
+	if err != nil {
+		return err
+	}
+
+	size := fragment.End - fragment.Begin
+	offset := upload.BytesAcked()
+	chunkSize := int64(initialUploadChunkSize)
+
+	for offset < size {
+		n := chunkSize
+		if offset+n > size {
+			n = size - offset
+		}
+		buffer := make([]byte, n)
+		if _, err := fragment.File.ReadAt(buffer, offset); err != nil && err != io.EOF {
+			return err
+		}
+		compressed, err := compressBuffer(codec, buffer)
+		if err != nil {
+			return err
+		}
+		if err := upload.WriteChunk(compressed); err != nil {
+			if serr := p.locks.SaveResumeToken(lockKey, upload.Token()); serr != nil {
+				log.Println("persister[", p.routeKey, "]: saving resume token:", serr)
+			}
+			return err
+		}
+		offset += n
+		if err := p.locks.SaveResumeToken(lockKey, upload.Token()); err != nil {
+			return err
+		}
+		chunkSize = nextUploadChunkSize(chunkSize)
+	}
+
+	if err := upload.Close(); err != nil {
+		return err
+	}
+	return p.locks.ClearResumeToken(lockKey)
+}
+
+// Open returns a reader over the converged, decompressed content of
+// |fragment|. It looks for the fragment under the journal's current codec,
+// then (if that codec isn't CodecNone) uncompressed; a fragment stored under
+// any other codec is not found.
+func (p *Persister) Open(fragment journal.Fragment) (io.ReadCloser, error) {
+	codec := p.codecFor(fragment.Journal)
+	remotePath := p.remotePath(fragment, codec)
+
+	rc, err := p.store.Open(remotePath)
+	if err == ErrObjectNotFound && codec != CodecNone {
+		// Fall back to a fragment persisted before compression was enabled
+		// for this journal.
+		remotePath = fragment.ContentPath()
+		if rc, err = p.store.Open(remotePath); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return decompressingReader(codecFromContentName(remotePath), rc)
+}
@@ -1,32 +1,105 @@
 package gazette
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/coreos/go-etcd/etcd"
 	gc "github.com/go-check/check"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/pippio/api-server/cloudstore"
-	"github.com/pippio/api-server/discovery"
 	"github.com/pippio/gazette/journal"
 )
 
+// fakeLockManager is an in-memory lockManager used in place of
+// etcdV3LockManager, so tests can assert on lock/unlock calls without a
+// live etcd.
+type fakeLockManager struct {
+	mu      sync.Mutex
+	held    map[string]bool
+	tryLock []string
+	unlock  []string
+	tokens  map[string]string
+}
+
+func newFakeLockManager() *fakeLockManager {
+	return &fakeLockManager{held: make(map[string]bool), tokens: make(map[string]string)}
+}
+
+func (f *fakeLockManager) TryLock(key string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tryLock = append(f.tryLock, key)
+	if f.held[key] {
+		return false, nil
+	}
+	f.held[key] = true
+	return true, nil
+}
+
+func (f *fakeLockManager) Unlock(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.unlock = append(f.unlock, key)
+	delete(f.held, key)
+	return nil
+}
+
+func (f *fakeLockManager) SaveResumeToken(key, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tokens[key] = token
+	return nil
+}
+
+func (f *fakeLockManager) LoadResumeToken(key string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.tokens[key], nil
+}
+
+func (f *fakeLockManager) ClearResumeToken(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.tokens, key)
+	return nil
+}
+
+// PersisterSuite exercises Persister.convergeOne against the "local"
+// ObjectStore backend over a temporary cloudstore.FileSystem (the same
+// backend used in production for single-node deployments), the only one that
+// can be driven without live cloud credentials. Persister is not run against
+// the S3/GCS/Azure backends here; their ObjectStore implementations are
+// exercised by objectStoreConformance under backend-specific build tags.
 type PersisterSuite struct {
-	etcd      *discovery.EtcdMemoryService
+	locks     *fakeLockManager
 	cfs       cloudstore.FileSystem
+	store     ObjectStore
 	file      *journal.MockFragmentFile
 	fragment  journal.Fragment
 	persister *Persister
 }
 
 func (s *PersisterSuite) SetUpTest(c *gc.C) {
-	s.etcd = discovery.NewEtcdMemoryService()
-	s.etcd.MakeDirectory(PersisterLocksRoot)
+	s.locks = newFakeLockManager()
 
 	s.cfs = cloudstore.NewTmpFileSystem()
+	s.store = newLocalObjectStore(s.cfs, "")
+
 	s.file = &journal.MockFragmentFile{}
 	s.fragment = journal.Fragment{
 		Journal: "a/journal",
@@ -36,7 +109,11 @@ func (s *PersisterSuite) SetUpTest(c *gc.C) {
 			11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 		File: s.file,
 	}
-	s.persister = NewPersister("base/directory", s.cfs, s.etcd, "route-key")
+	s.persister = newPersister("base/directory", s.store, s.locks, "route-key", 1, 0)
+	// Most of this suite predates per-journal compression and asserts exact
+	// byte content; pin this journal to CodecNone so those assertions keep
+	// holding. TestPersistenceWithCompression below covers the zstd path.
+	s.persister.SetJournalCodec(s.fragment.Journal, CodecNone)
 }
 
 func (s *PersisterSuite) TearDownTest(c *gc.C) {
@@ -46,31 +123,8 @@ func (s *PersisterSuite) TearDownTest(c *gc.C) {
 func (s *PersisterSuite) TestPersistence(c *gc.C) {
 	kContentFixture := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
 
-	// Monitor persister locks. Expect a lock to be obtained, refreshed,
-	// and then released.
-	subscriber := &discovery.MockEtcdSubscriber{}
-	s.expectLockUnlock(subscriber, c)
-	blockUntilRefresh := make(chan time.Time)
-
-	subscriber.On("OnEtcdUpdate", mock.MatchedBy(func(r *etcd.Response) bool {
-		if r.Action != discovery.EtcdUpdateOp {
-			return false
-		}
-		c.Check(r.Node.Key, gc.Equals, PersisterLocksRoot+s.fragment.ContentName())
-
-		if blockUntilRefresh != nil {
-			close(blockUntilRefresh)
-			blockUntilRefresh = nil
-		}
-		return true
-	}), mock.AnythingOfType("*etcd.Node"))
-
-	c.Check(s.etcd.Subscribe(PersisterLocksRoot, subscriber), gc.IsNil)
-
-	// Expect fragment.File to be read. Return a value fixture we'll verify later.
 	s.file.On("ReadAt", mock.AnythingOfType("[]uint8"), int64(0)).
 		Return(10, nil).
-		WaitUntil(blockUntilRefresh). // Delay until a lock refresh occurrs.
 		Run(func(args mock.Arguments) {
 		copy(args.Get(0).([]byte), kContentFixture)
 	}).Once()
@@ -82,10 +136,11 @@ func (s *PersisterSuite) TestPersistence(c *gc.C) {
 		return nil
 	}
 
-	s.persister.persisterLockTTL = time.Millisecond
 	s.persister.convergeOne(s.fragment)
 
-	subscriber.AssertExpectations(c)
+	// Expect a lock to be obtained for the fragment, and then released.
+	c.Check(s.locks.tryLock, gc.DeepEquals, []string{s.fragment.ContentName()})
+	c.Check(s.locks.unlock, gc.DeepEquals, []string{s.fragment.ContentName()})
 	s.file.AssertExpectations(c)
 	c.Check(s.persister.osRemove, gc.IsNil)
 
@@ -96,13 +151,143 @@ func (s *PersisterSuite) TestPersistence(c *gc.C) {
 	c.Check(content, gc.DeepEquals, kContentFixture)
 }
 
-func (s *PersisterSuite) TestLockIsAlreadyHeld(c *gc.C) {
-	s.etcd.Create(PersisterLocksRoot+s.fragment.ContentName(), "another-broker", 0)
+func (s *PersisterSuite) TestPersistenceWithCompression(c *gc.C) {
+	s.persister.SetJournalCodec(s.fragment.Journal, CodecZstd)
+	kContentFixture := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+	remotePath := s.persister.remotePath(s.fragment, CodecZstd)
+
+	s.file.On("ReadAt", mock.AnythingOfType("[]uint8"), int64(0)).
+		Return(10, nil).
+		Run(func(args mock.Arguments) {
+		copy(args.Get(0).([]byte), kContentFixture)
+	}).Once()
+
+	s.persister.osRemove = func(string) error { return nil }
+	s.persister.convergeOne(s.fragment)
+
+	c.Check(s.locks.tryLock, gc.HasLen, 1)
+	c.Check(s.locks.unlock, gc.HasLen, 1)
+	s.file.AssertExpectations(c)
+
+	// The uploaded bytes are a valid zstd stream which decodes back to the
+	// original fixture.
+	r, err := s.store.Open(remotePath)
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+
+	zr, err := zstd.NewReader(r)
+	c.Assert(err, gc.IsNil)
+	defer zr.Close()
+
+	content, err := ioutil.ReadAll(zr)
+	c.Assert(err, gc.IsNil)
+	c.Check(content, gc.DeepEquals, kContentFixture)
+
+	// And Persister.Open transparently decompresses it back out.
+	rc, err := s.persister.Open(s.fragment)
+	c.Assert(err, gc.IsNil)
+	defer rc.Close()
+
+	content, err = ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Check(content, gc.DeepEquals, kContentFixture)
+}
+
+// flakyChunkedStore wraps a ChunkedObjectStore and fails the |failAtCall|'th
+// WriteChunk invocation across its lifetime (counting from 1), simulating a
+// process crash partway through a chunked upload so TestResumesChunkedUpload
+// can verify convergence picks up from the last acknowledged chunk on retry.
+type flakyChunkedStore struct {
+	ChunkedObjectStore
+	failAtCall int
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *flakyChunkedStore) OpenChunkedUpload(path, resumeToken string) (ChunkedUpload, error) {
+	inner, err := s.ChunkedObjectStore.OpenChunkedUpload(path, resumeToken)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyChunkedUpload{store: s, inner: inner}, nil
+}
+
+type flakyChunkedUpload struct {
+	store *flakyChunkedStore
+	inner ChunkedUpload
+}
+
+func (u *flakyChunkedUpload) BytesAcked() int64 { return u.inner.BytesAcked() }
+func (u *flakyChunkedUpload) Token() string     { return u.inner.Token() }
+
+func (u *flakyChunkedUpload) WriteChunk(chunk []byte) error {
+	u.store.mu.Lock()
+	u.store.calls++
+	fail := u.store.calls == u.store.failAtCall
+	u.store.mu.Unlock()
+
+	if fail {
+		return errors.New("simulated upload failure")
+	}
+	return u.inner.WriteChunk(chunk)
+}
+
+func (u *flakyChunkedUpload) Close() error { return u.inner.Close() }
+
+func (s *PersisterSuite) TestResumesChunkedUpload(c *gc.C) {
+	const chunk = initialUploadChunkSize
 
-	// Expect that no persister lock changes are made.
-	subscriber := &discovery.MockEtcdSubscriber{}
-	subscriber.On("OnEtcdUpdate", mock.Anything, mock.Anything).Return().Once()
-	c.Check(s.etcd.Subscribe(PersisterLocksRoot, subscriber), gc.IsNil)
+	part1 := bytes.Repeat([]byte{0xaa}, chunk)
+	part2 := bytes.Repeat([]byte{0xbb}, chunk/2)
+
+	s.fragment.Begin = 0
+	s.fragment.End = int64(len(part1) + len(part2))
+
+	s.file.On("ReadAt", mock.AnythingOfType("[]uint8"), int64(0)).
+		Return(len(part1), nil).
+		Run(func(args mock.Arguments) { copy(args.Get(0).([]byte), part1) }).
+		Once()
+	s.file.On("ReadAt", mock.AnythingOfType("[]uint8"), int64(len(part1))).
+		Return(len(part2), nil).
+		Run(func(args mock.Arguments) { copy(args.Get(0).([]byte), part2) }).
+		Twice()
+
+	store := &flakyChunkedStore{ChunkedObjectStore: s.store.(ChunkedObjectStore), failAtCall: 2}
+	s.persister = newPersister("base/directory", store, s.locks, "route-key", 1, 0)
+	s.persister.SetJournalCodec(s.fragment.Journal, CodecNone)
+
+	// First attempt: the first chunk uploads and is acknowledged, but the
+	// second (and final) chunk fails, simulating a crash mid-upload.
+	s.persister.convergeOne(s.fragment)
+
+	// Second attempt, as if a restarted broker re-converged the fragment: it
+	// should resume from the acknowledged first chunk rather than re-reading
+	// it, and complete successfully this time.
+	s.persister.osRemove = func(path string) error {
+		c.Check(path, gc.Equals, "base/directory/a/journal/"+s.fragment.ContentName())
+		s.persister.osRemove = nil
+		return nil
+	}
+	s.persister.convergeOne(s.fragment)
+
+	s.file.AssertExpectations(c)
+	c.Check(s.persister.osRemove, gc.IsNil)
+
+	r, err := s.store.Open(s.fragment.ContentPath())
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Check(content, gc.DeepEquals, append(append([]byte{}, part1...), part2...))
+}
+
+func (s *PersisterSuite) TestLockIsAlreadyHeld(c *gc.C) {
+	held, err := s.locks.TryLock(s.fragment.ContentName())
+	c.Assert(err, gc.IsNil)
+	c.Assert(held, gc.Equals, true)
 
 	// Note we're implicitly verifying that the local file is not read,
 	// by not setting up expectations.
@@ -115,28 +300,16 @@ func (s *PersisterSuite) TestLockIsAlreadyHeld(c *gc.C) {
 	}
 	s.persister.convergeOne(s.fragment)
 
-	subscriber.AssertExpectations(c)
 	s.file.AssertExpectations(c)
 
-	// Expect it's not present on target filesystem.
-	_, err := s.cfs.Open(s.fragment.ContentPath())
-	c.Check(os.IsNotExist(err), gc.Equals, true)
+	// Expect it's not present on the remote store.
+	_, err = s.store.Stat(s.fragment.ContentPath())
+	c.Check(err, gc.Equals, ErrObjectNotFound)
 }
 
 func (s *PersisterSuite) TestTargetFileAlreadyExists(c *gc.C) {
-	{
-		c.Assert(s.cfs.MkdirAll(s.fragment.Journal.String(), 0740), gc.IsNil)
-		w, err := s.cfs.OpenFile(s.fragment.ContentPath(),
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
-		c.Check(err, gc.IsNil)
-		w.Write([]byte("previous-content"))
-		c.Assert(w.Close(), gc.IsNil)
-	}
-
-	// Expect a lock to be obtained, and then released.
-	subscriber := &discovery.MockEtcdSubscriber{}
-	s.expectLockUnlock(subscriber, c)
-	c.Check(s.etcd.Subscribe(PersisterLocksRoot, subscriber), gc.IsNil)
+	c.Assert(s.store.Upload(s.fragment.ContentPath(),
+		strings.NewReader("previous-content"), nil), gc.IsNil)
 
 	// Expect fragment.File is *not* read, but that the file *is* removed.
 	s.persister.osRemove = func(path string) error {
@@ -146,40 +319,13 @@ func (s *PersisterSuite) TestTargetFileAlreadyExists(c *gc.C) {
 	}
 	s.persister.convergeOne(s.fragment)
 
-	subscriber.AssertExpectations(c)
+	// Expect a lock to be obtained, and then released.
+	c.Check(s.locks.tryLock, gc.DeepEquals, []string{s.fragment.ContentName()})
+	c.Check(s.locks.unlock, gc.DeepEquals, []string{s.fragment.ContentName()})
 	s.file.AssertExpectations(c)
 	c.Check(s.persister.osRemove, gc.IsNil)
 }
 
-func (s *PersisterSuite) expectLockUnlock(sub *discovery.MockEtcdSubscriber, c *gc.C) {
-	treeArg := mock.AnythingOfType("*etcd.Node")
-	lockKey := PersisterLocksRoot + s.fragment.ContentName()
-
-	// Expect callback on initial subscription.
-	sub.On("OnEtcdUpdate", mock.MatchedBy(func(r *etcd.Response) bool {
-		return r.Action == discovery.EtcdGetOp
-	}), treeArg).Return().Once()
-
-	// Expect a persister lock to be created.
-	sub.On("OnEtcdUpdate", mock.MatchedBy(func(r *etcd.Response) bool {
-		if r.Action != discovery.EtcdCreateOp {
-			return false
-		}
-		c.Check(r.Node.Key, gc.Equals, lockKey)
-		c.Check(r.Node.Value, gc.Equals, "route-key")
-		return true
-	}), treeArg).Return().Once()
-
-	// Expect a persister lock to be released.
-	sub.On("OnEtcdUpdate", mock.MatchedBy(func(r *etcd.Response) bool {
-		if r.Action != discovery.EtcdDeleteOp {
-			return false
-		}
-		c.Check(r.Node.Key, gc.Equals, lockKey)
-		return true
-	}), treeArg).Return().Once()
-}
-
 func (s *PersisterSuite) TestStringFunction(c *gc.C) {
 	// Make sure that JSON marshaler doesn't choke on the |File| field.
 	fp, err := os.Open("/dev/urandom")
@@ -200,4 +346,146 @@ func (s *PersisterSuite) TestStringFunction(c *gc.C) {
 		`{"a/journal":["00000000000003e8-00000000000003f2-0102030405060708090a0b0c0d0e0f1011121314","00000000000007d0-0000000000000bb8-0102030405060708090a0b0c0d0e0f1011121314"]}`)
 }
 
+// sleepingStore wraps an ObjectStore, delaying every Upload. It models a
+// slow remote backend for TestConcurrentConvergence.
+type sleepingStore struct {
+	ObjectStore
+	sleep time.Duration
+}
+
+func (s sleepingStore) Upload(path string, r io.Reader, attrs *ObjectAttrs) error {
+	time.Sleep(s.sleep)
+	return s.ObjectStore.Upload(path, r, attrs)
+}
+
+func (s *PersisterSuite) TestConcurrentConvergence(c *gc.C) {
+	const (
+		numFragments = 100
+		concurrency  = 8
+		sleep        = 20 * time.Millisecond
+	)
+
+	store := sleepingStore{
+		ObjectStore: newLocalObjectStore(cloudstore.NewTmpFileSystem(), ""),
+		sleep:       sleep,
+	}
+	persister := newPersister("base/directory", store, newFakeLockManager(), "route-key", concurrency, 0)
+	persister.osRemove = func(string) error { return nil }
+
+	fragments := make([]journal.Fragment, numFragments)
+	for i := range fragments {
+		file := &journal.MockFragmentFile{}
+		file.On("ReadAt", mock.AnythingOfType("[]uint8"), int64(0)).Return(10, nil)
+
+		fragments[i] = journal.Fragment{
+			Journal: journal.Name(fmt.Sprintf("journal-%d", i)),
+			Begin:   0,
+			End:     10,
+			File:    file,
+		}
+		persister.SetJournalCodec(fragments[i].Journal, CodecNone)
+	}
+
+	persister.Start()
+	started := time.Now()
+	for _, fragment := range fragments {
+		persister.Persist(fragment)
+	}
+	persister.Stop()
+	elapsed := time.Since(started)
+
+	bound := time.Duration(math.Ceil(float64(numFragments)/float64(concurrency))) * sleep
+	c.Check(elapsed < bound*3, gc.Equals, true) // Generous slack for scheduling jitter.
+}
+
+// blockingStore wraps an ObjectStore, letting a test synchronize with the
+// moment Upload starts and hold it open until signaled. It models an
+// in-flight upload for TestDuplicateConvergenceReleasesBudget.
+type blockingStore struct {
+	ObjectStore
+	started chan struct{}
+	proceed chan struct{}
+}
+
+func (s *blockingStore) Upload(path string, r io.Reader, attrs *ObjectAttrs) error {
+	s.started <- struct{}{}
+	<-s.proceed
+	return s.ObjectStore.Upload(path, r, attrs)
+}
+
+func (s *PersisterSuite) TestDuplicateConvergenceReleasesBudget(c *gc.C) {
+	const size = 10
+	s.fragment.Begin, s.fragment.End = 0, size
+
+	s.file.On("ReadAt", mock.AnythingOfType("[]uint8"), int64(0)).Return(size, nil).Once()
+
+	store := &blockingStore{
+		ObjectStore: newLocalObjectStore(cloudstore.NewTmpFileSystem(), ""),
+		started:     make(chan struct{}),
+		proceed:     make(chan struct{}),
+	}
+	persister := newPersister("base/directory", store, newFakeLockManager(), "route-key", 2, 0)
+	persister.SetJournalCodec(s.fragment.Journal, CodecNone)
+	persister.osRemove = func(string) error { return nil }
+	persister.Start()
+
+	persister.Persist(s.fragment)
+	<-store.started // The first worker is now blocked inside Upload, with
+	// inFlightFragments already marking the fragment in-flight.
+
+	persister.Persist(s.fragment) // Duplicate: queued while the first is still converging.
+
+	// The duplicate's worker should observe the in-flight fragment and
+	// release its share of the budget without waiting on the first upload.
+	deadline := time.After(time.Second)
+	for {
+		persister.mu.Lock()
+		inFlight := persister.inFlightBytes
+		persister.mu.Unlock()
+		if inFlight == size {
+			break
+		}
+		select {
+		case <-deadline:
+			c.Fatalf("timed out waiting for duplicate convergence to release its budget, inFlightBytes=%d", inFlight)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	close(store.proceed)
+	persister.Stop()
+
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+	c.Check(persister.inFlightBytes, gc.Equals, int64(0))
+	s.file.AssertExpectations(c)
+}
+
+func (s *PersisterSuite) TestOversizedFragmentIsNotDeadlocked(c *gc.C) {
+	const maxInFlightBytes = 5
+	s.fragment.Begin, s.fragment.End = 0, 10 // Larger than maxInFlightBytes.
+
+	s.file.On("ReadAt", mock.AnythingOfType("[]uint8"), int64(0)).Return(10, nil).Once()
+
+	persister := newPersister("base/directory", s.store, s.locks, "route-key", 1, maxInFlightBytes)
+	persister.SetJournalCodec(s.fragment.Journal, CodecNone)
+	persister.osRemove = func(string) error { return nil }
+	persister.Start()
+
+	done := make(chan struct{})
+	go func() {
+		persister.Persist(s.fragment) // Must not block forever waiting for budget it can never fit.
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("Persist deadlocked on a fragment larger than maxInFlightBytes")
+	}
+
+	persister.Stop()
+	s.file.AssertExpectations(c)
+}
+
 var _ = gc.Suite(&PersisterSuite{})
@@ -0,0 +1,53 @@
+package gazette
+
+// ChunkedObjectStore is implemented by ObjectStore backends that can accept
+// an upload as a sequence of ordered chunks and resume a previously
+// interrupted one. Persister type-asserts for it and falls back to
+// buffering the whole fragment and calling ObjectStore.Upload directly
+// against backends that don't implement it.
+type ChunkedObjectStore interface {
+	ObjectStore
+
+	// OpenChunkedUpload begins, or — given a non-empty |resumeToken|
+	// returned by a prior ChunkedUpload.Token() — resumes, a chunked upload
+	// to |path|.
+	OpenChunkedUpload(path string, resumeToken string) (ChunkedUpload, error)
+}
+
+// ChunkedUpload is a single in-progress chunked upload.
+type ChunkedUpload interface {
+	// BytesAcked is how many bytes of the object have already been durably
+	// written, whether by this session or one it resumed from; the caller
+	// should resume reading its source data at this offset.
+	BytesAcked() int64
+	// Token identifies this session well enough that a future
+	// OpenChunkedUpload can resume it after a crash.
+	Token() string
+	// WriteChunk durably appends |chunk|, the next sequential chunk of the
+	// object, and advances BytesAcked by len(chunk).
+	WriteChunk(chunk []byte) error
+	// Close finalizes the upload. The S3, GCS and Azure backends make the
+	// object visible to Stat/Open only once Close succeeds; the local backend
+	// writes in place, so a partial object is visible before then.
+	Close() error
+}
+
+const (
+	// initialUploadChunkSize is the chunk size a fresh upload starts at.
+	initialUploadChunkSize = 8 << 20 // 8 MiB
+	// maxUploadChunkSize bounds how large a chunk is allowed to grow to.
+	maxUploadChunkSize = 64 << 20 // 64 MiB
+)
+
+// nextUploadChunkSize doubles the chunk size after every successful chunk,
+// up to maxUploadChunkSize, so a sustained upload of a large fragment
+// quickly stops paying per-chunk overhead. It does not measure throughput
+// and does not shrink the chunk size on error: uploadChunked's chunkSize is
+// local to a single call and simply restarts at initialUploadChunkSize on
+// the next attempt, the same as a fresh upload's.
+func nextUploadChunkSize(current int64) int64 {
+	if next := current * 2; next <= maxUploadChunkSize {
+		return next
+	}
+	return maxUploadChunkSize
+}